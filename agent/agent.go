@@ -1,16 +1,15 @@
 package agent
 
 import (
-	"bufio"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"net/http"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/Dataman-Cloud/swan/src/config"
 	eventbus "github.com/Dataman-Cloud/swan/src/event"
+	"github.com/Dataman-Cloud/swan/src/internal/sse"
 	"github.com/Dataman-Cloud/swan/src/janitor"
 	"github.com/Dataman-Cloud/swan/src/janitor/upstream"
 	"github.com/Dataman-Cloud/swan/src/nameserver"
@@ -23,9 +22,6 @@ import (
 )
 
 const REJOIN_BACKOFF = 3 * time.Second
-const SSE_DATA_PREFIX = "data:"
-const SSE_EVENT_PREFIX = "event:"
-const SSE_BLANK_LINE = ""
 
 // Agent struct
 type Agent struct {
@@ -34,6 +30,25 @@ type Agent struct {
 	HTTPServer *HTTPServer
 	Config     config.AgentConfig
 	eventCh    chan *event
+
+	ctx context.Context
+
+	// lastEventID is the ID of the most recently consumed master event,
+	// sent back as Last-Event-ID on reconnect so watchManagerEvents can
+	// resume without gaps or duplicates.
+	lastEventID string
+
+	discoverers      []LeaderDiscoverer
+	discoveryMetrics *DiscoveryMetrics
+
+	supervisor   *Supervisor
+	dispatchDone chan struct{}
+
+	// lastKnownLeader is kept around so a transient detect failure can
+	// retry the previously working manager first instead of starting the
+	// race from scratch.
+	lastKnownLeaderMu sync.Mutex
+	lastKnownLeader   string
 }
 
 type event struct {
@@ -44,71 +59,109 @@ type event struct {
 // New agent func
 func New(agentConf config.AgentConfig) *Agent {
 	agent := &Agent{
-		Config:   agentConf,
-		Resolver: nameserver.NewResolver(&agentConf.DNS),
-		Janitor:  janitor.NewJanitorServer(&agentConf.Janitor),
-		eventCh:  make(chan *event, 1024),
+		Config:           agentConf,
+		Resolver:         nameserver.NewResolver(&agentConf.DNS),
+		Janitor:          janitor.NewJanitorServer(&agentConf.Janitor),
+		eventCh:          make(chan *event, 1024),
+		ctx:              context.Background(),
+		discoverers:      buildDiscoverers(agentConf),
+		discoveryMetrics: &DiscoveryMetrics{},
 	}
 	agent.HTTPServer = NewHTTPServer(agentConf.ListenAddr, agent)
 	return agent
 }
 
-// StartAndJoin func
-func (agent *Agent) StartAndJoin() error {
-	errCh := make(chan error)
+// buildDiscoverers assembles the active LeaderDiscoverer set from
+// Config.Discovery: the static JoinAddrs list is always included, with
+// DNS-SRV and mDNS layered in when configured.
+func buildDiscoverers(agentConf config.AgentConfig) []LeaderDiscoverer {
+	discoverers := []LeaderDiscoverer{NewStaticDiscoverer(agentConf.JoinAddrs)}
 
-	go func() {
-		err := agent.Resolver.Start()
-		if err != nil {
-			errCh <- err
-		}
-		logrus.Warnln("resolver quit, error:", err)
-	}()
+	if agentConf.Discovery.DNSSRVService != "" {
+		discoverers = append(discoverers, NewDNSSRVDiscoverer(agentConf.Discovery.DNSSRVService))
+	}
+	if agentConf.Discovery.EnableMDNS {
+		discoverers = append(discoverers, NewMDNSDiscoverer(agentConf.Discovery.MDNSTimeout))
+	}
 
-	go func() {
-		err := agent.Janitor.Start()
-		if err != nil {
-			errCh <- err
-		}
-		logrus.Warnln("janitor quit, error:", err)
-	}()
+	return discoverers
+}
 
-	go func() {
-		err := agent.HTTPServer.Start()
-		if err != nil {
-			errCh <- err
-		}
-		logrus.Warnln("http server quit, error:", err)
-	}()
+// StartAndJoin starts every long-running component under a Supervisor:
+// Resolver, Janitor and HTTPServer run as Services that stop the whole
+// agent if any of them fails; watchEvents is crash-only and gets
+// respawned with backoff on its own instead of taking the agent down.
+// StartAndJoin blocks until a fatal error brings the supervisor down or
+// Shutdown is called, and returns the aggregated error, if any.
+func (agent *Agent) StartAndJoin() error {
+	sup, ctx := NewSupervisor(agent.ctx)
+	agent.supervisor = sup
+	agent.ctx = ctx
+	agent.dispatchDone = make(chan struct{})
+
+	sup.Run(ctx,
+		supervisedService{name: "resolver", svc: agent.Resolver, restart: restartNever},
+		supervisedService{name: "janitor", svc: agent.Janitor, restart: restartNever},
+		supervisedService{name: "http server", svc: agent.HTTPServer, restart: restartNever},
+		supervisedService{name: "watch events", svc: watchEventsService{agent}, restart: restartAlways},
+	)
 
-	go agent.watchEvents()
 	go agent.dispatchEvents()
 
-	return <-errCh
+	return sup.Wait()
 }
 
-// watchEvents establish a connection to swan master's stream events endpoint
-// and broadcast received events
-func (agent *Agent) watchEvents() {
-	for {
-		leaderAddr, err := agent.detectManagerLeader()
-		if err != nil {
-			logrus.Errorf("detect manager leader got error: %v, retry ...", err)
-			time.Sleep(REJOIN_BACKOFF)
-			continue
-		}
-		logrus.Printf("detected manager addr %s, listening on events ...", leaderAddr)
+// Shutdown stops every supervised service, then closes eventCh (after any
+// in-flight watchEvents send has been given a chance to land) and waits
+// for dispatchEvents to drain and exit, so callers get a clean, complete
+// teardown instead of leaking goroutines.
+func (agent *Agent) Shutdown(ctx context.Context) error {
+	if agent.supervisor != nil {
+		agent.supervisor.Stop()
+	}
 
-		err = agent.watchManagerEvents(leaderAddr)
-		if err != nil {
-			logrus.Errorf("watch manager events got error: %v, retry ...", err)
-			time.Sleep(REJOIN_BACKOFF)
-		}
+	close(agent.eventCh)
+
+	select {
+	case <-agent.dispatchDone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// watchEventsService adapts Agent.watchEventsOnce to the Service interface
+// so the Supervisor can crash-restart it independently of its siblings.
+type watchEventsService struct {
+	agent *Agent
+}
+
+func (w watchEventsService) Serve(ctx context.Context) error {
+	return w.agent.watchEventsOnce(ctx)
+}
+
+func (w watchEventsService) Stop() error { return nil }
+
+// watchEventsOnce detects the current manager leader and streams its
+// events. The SSE client reconnects to that same leader on stream
+// failures, so this returns only when detection fails or ctx is
+// cancelled; the Supervisor calls it again with backoff after a failure.
+func (agent *Agent) watchEventsOnce(ctx context.Context) error {
+	leaderAddr, err := agent.detectManagerLeader()
+	if err != nil {
+		return fmt.Errorf("detect manager leader: %s", err)
 	}
+	logrus.Printf("detected manager addr %s, listening on events ...", leaderAddr)
+
+	return agent.watchManagerEvents(leaderAddr)
 }
 
-// dispatchEvents dispatch received events to dns & proxy goroutines
+// dispatchEvents dispatch received events to dns & proxy goroutines. It
+// runs until eventCh is closed (by Shutdown), at which point it signals
+// dispatchDone so Shutdown knows it's safe to return.
 func (agent *Agent) dispatchEvents() {
+	defer close(agent.dispatchDone)
+
 	// send proxy info to dns proxy listener
 	agent.Resolver.EmitChange(&nameserver.RecordChangeEvent{
 		Change: "add",
@@ -141,22 +194,44 @@ func (agent *Agent) dispatchEvents() {
 	}
 }
 
-// todo
+// detectManagerLeader finds a reachable swan master by racing every
+// configured LeaderDiscoverer (static JoinAddrs, DNS-SRV, mDNS, ...)
+// concurrently and keeping whichever answers first. The last known leader
+// is tried first for sticky reconnects, so a brief blip doesn't bounce the
+// agent to a different manager than the one it was already talking to.
 func (agent *Agent) detectManagerLeader() (leaderAddr string, err error) {
-	for _, managerAddr := range agent.Config.JoinAddrs {
-		nodeRegistrationPath := managerAddr + "/ping"
-		_, err := httpclient.NewDefaultClient().GET(context.TODO(), nodeRegistrationPath, nil, nil)
-		if err != nil {
-			logrus.Infof("register to %s got error: %s", nodeRegistrationPath, err.Error())
-			continue
+	if sticky := agent.getLastKnownLeader(); sticky != "" {
+		if _, pingErr := httpclient.NewDefaultClient().GET(context.TODO(), sticky+"/ping", nil, nil); pingErr == nil {
+			agent.setLastKnownLeader(sticky)
+			return sticky, nil
 		}
+	}
 
-		return managerAddr, nil
+	leaderAddr, err = raceDiscoverers(agent.ctx, agent.discoverers, agent.discoveryMetrics)
+	if err != nil {
+		return "", errors.New("try join all managers are failed")
 	}
 
-	return "", errors.New("try join all managers are failed")
+	agent.setLastKnownLeader(leaderAddr)
+	return leaderAddr, nil
+}
+
+func (agent *Agent) getLastKnownLeader() string {
+	agent.lastKnownLeaderMu.Lock()
+	defer agent.lastKnownLeaderMu.Unlock()
+	return agent.lastKnownLeader
 }
 
+func (agent *Agent) setLastKnownLeader(addr string) {
+	agent.lastKnownLeaderMu.Lock()
+	defer agent.lastKnownLeaderMu.Unlock()
+	agent.lastKnownLeader = addr
+}
+
+// watchManagerEvents keeps a long-lived SSE connection to the swan master's
+// /events endpoint, resuming from the last received event ID (via
+// Last-Event-ID) on every reconnect so catchUp=true never re-delivers or
+// drops events across a flaky link.
 func (agent *Agent) watchManagerEvents(leaderAddr string) error {
 	eventsDoesMatter := []string{
 		eventbus.EventTypeTaskUnhealthy,
@@ -165,46 +240,31 @@ func (agent *Agent) watchManagerEvents(leaderAddr string) error {
 	}
 
 	eventsPath := fmt.Sprintf("http://%s/events?catchUp=true", leaderAddr)
-	resp, err := http.Get(eventsPath)
-	if err != nil {
-		return err
+	client := sse.NewClient(eventsPath)
+	if agent.lastEventID != "" {
+		client.Header.Set("Last-Event-ID", agent.lastEventID)
 	}
-	defer resp.Body.Close()
 
-	reader := bufio.NewReader(resp.Body)
-	for {
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			return err
+	err := client.Run(agent.ctx, func(evt sse.Event) error {
+		// evt.ID is the ID of the event being delivered right now; client's
+		// own lastEventID isn't advanced to it until after this callback
+		// returns, so reading that back here would always lag by one event.
+		if evt.ID != "" {
+			agent.lastEventID = evt.ID
 		}
 
-		// skip blank line
-		if line == SSE_BLANK_LINE {
-			continue
+		if !utils.SliceContains(eventsDoesMatter, evt.Event) {
+			return nil
 		}
 
-		if strings.HasPrefix(line, SSE_EVENT_PREFIX) {
-			eventType := strings.TrimSpace(line[len(SSE_EVENT_PREFIX):len(line)])
-			if !utils.SliceContains(eventsDoesMatter, eventType) {
-				continue
-			}
-
-			// read next line of stream
-			line, err := reader.ReadString('\n')
-			if err != nil {
-				return err
-			}
-			// if line is not data section
-			if !strings.HasPrefix(line, SSE_DATA_PREFIX) {
-				continue
-			}
-
-			agent.eventCh <- &event{
-				name:    eventType,
-				payload: []byte(line[len(SSE_DATA_PREFIX):len(line)]),
-			}
+		agent.eventCh <- &event{
+			name:    evt.Event,
+			payload: []byte(evt.Data),
 		}
-	}
+		return nil
+	})
+
+	return err
 }
 
 func recordChangeEventFromTaskInfoEvent(eventType string, taskInfoEvent *types.TaskEvent) *nameserver.RecordChangeEvent {
@@ -249,6 +309,10 @@ func genJanitorBackendEvent(eventType string, taskInfoEvent *types.TaskInfoEvent
 		port    = taskInfoEvent.Port
 		weight  = taskInfoEvent.Weight
 		version = taskInfoEvent.VersionID
+
+		// PROXY protocol to emit when dialing this backend, opted into
+		// per-app via task metadata. 0 disables it.
+		proxyProtocol = taskInfoEvent.ProxyProtocol
 	)
 
 	switch eventType {
@@ -262,5 +326,5 @@ func genJanitorBackendEvent(eventType string, taskInfoEvent *types.TaskInfoEvent
 		return nil
 	}
 
-	return upstream.BuildBackendEvent(act, ups, alias, listen, backend, ip, version, port, weight)
+	return upstream.BuildBackendEvent(act, ups, alias, listen, backend, ip, version, port, weight, proxyProtocol)
 }
\ No newline at end of file
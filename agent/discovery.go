@@ -0,0 +1,200 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Dataman-Cloud/swan/src/utils/httpclient"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/grandcat/zeroconf"
+	"golang.org/x/net/context"
+)
+
+// mdnsServiceName is the mDNS/zeroconf service type agents browse for when
+// the zeroconf discoverer is enabled.
+const mdnsServiceName = "_swan-manager._tcp"
+
+// LeaderDiscoverer finds a reachable swan master. Agent.detectManagerLeader
+// races every configured discoverer concurrently and keeps whichever
+// answers first, so a slow or unreachable discovery method never blocks the
+// others.
+type LeaderDiscoverer interface {
+	// Name identifies the discoverer for logging and metrics.
+	Name() string
+	// Discover returns the address of a reachable manager, or an error if
+	// none could be found before ctx is done.
+	Discover(ctx context.Context) (addr string, err error)
+}
+
+// DiscoveryMetrics records the latency and winning discoverer of the most
+// recent successful leader discovery, plus a count of successful lookups.
+type DiscoveryMetrics struct {
+	mu           sync.Mutex
+	LastLatency  time.Duration
+	LastWinner   string
+	TotalLookups int64
+}
+
+func (m *DiscoveryMetrics) record(winner string, latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.LastWinner = winner
+	m.LastLatency = latency
+	m.TotalLookups++
+}
+
+// Snapshot returns a copy of the current metrics, safe to read concurrently
+// with further lookups.
+func (m *DiscoveryMetrics) Snapshot() DiscoveryMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return DiscoveryMetrics{LastLatency: m.LastLatency, LastWinner: m.LastWinner, TotalLookups: m.TotalLookups}
+}
+
+// staticDiscoverer pings each of a fixed list of manager addresses and
+// returns the first that answers /ping. This is the pre-existing behaviour,
+// now expressed as a LeaderDiscoverer so it composes with the others.
+type staticDiscoverer struct {
+	addrs []string
+}
+
+// NewStaticDiscoverer returns a LeaderDiscoverer backed by a static list of
+// manager addresses, as configured via Config.JoinAddrs.
+func NewStaticDiscoverer(addrs []string) LeaderDiscoverer {
+	return &staticDiscoverer{addrs: addrs}
+}
+
+func (d *staticDiscoverer) Name() string { return "static" }
+
+func (d *staticDiscoverer) Discover(ctx context.Context) (string, error) {
+	for _, managerAddr := range d.addrs {
+		nodeRegistrationPath := managerAddr + "/ping"
+		_, err := httpclient.NewDefaultClient().GET(ctx, nodeRegistrationPath, nil, nil)
+		if err != nil {
+			logrus.Infof("static discovery: ping %s got error: %s", nodeRegistrationPath, err.Error())
+			continue
+		}
+		return managerAddr, nil
+	}
+	return "", fmt.Errorf("static discovery: all join addrs failed")
+}
+
+// dnsSRVDiscoverer resolves a manager address via a DNS SRV record, e.g.
+// _swan-manager._tcp.example.com.
+type dnsSRVDiscoverer struct {
+	service string // e.g. "_swan-manager._tcp.example.com"
+}
+
+// NewDNSSRVDiscoverer returns a LeaderDiscoverer that resolves service (a
+// fully qualified SRV name) to a manager address.
+func NewDNSSRVDiscoverer(service string) LeaderDiscoverer {
+	return &dnsSRVDiscoverer{service: service}
+}
+
+func (d *dnsSRVDiscoverer) Name() string { return "dns-srv" }
+
+func (d *dnsSRVDiscoverer) Discover(ctx context.Context) (string, error) {
+	_, addrs, err := net.DefaultResolver.LookupSRV(ctx, "", "", d.service)
+	if err != nil {
+		return "", fmt.Errorf("dns-srv discovery: lookup %s: %s", d.service, err)
+	}
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("dns-srv discovery: no SRV records for %s", d.service)
+	}
+
+	// addrs are already sorted by priority/weight by the resolver; take the
+	// first entry.
+	best := addrs[0]
+	return fmt.Sprintf("%s:%d", best.Target, best.Port), nil
+}
+
+// mdnsDiscoverer browses for swan managers advertised on the local network
+// via mDNS/zeroconf, for zero-config LAN deployments.
+type mdnsDiscoverer struct {
+	timeout time.Duration
+}
+
+// NewMDNSDiscoverer returns a LeaderDiscoverer that browses the LAN for a
+// manager advertising the swan mDNS service.
+func NewMDNSDiscoverer(timeout time.Duration) LeaderDiscoverer {
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	return &mdnsDiscoverer{timeout: timeout}
+}
+
+func (d *mdnsDiscoverer) Name() string { return "mdns" }
+
+func (d *mdnsDiscoverer) Discover(ctx context.Context) (string, error) {
+	resolver, err := zeroconf.NewResolver(nil)
+	if err != nil {
+		return "", fmt.Errorf("mdns discovery: %s", err)
+	}
+
+	entries := make(chan *zeroconf.ServiceEntry, 4)
+	browseCtx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	if err := resolver.Browse(browseCtx, mdnsServiceName, "local.", entries); err != nil {
+		return "", fmt.Errorf("mdns discovery: browse: %s", err)
+	}
+
+	select {
+	case entry := <-entries:
+		if entry == nil || len(entry.AddrIPv4) == 0 {
+			return "", fmt.Errorf("mdns discovery: empty service entry")
+		}
+		return fmt.Sprintf("%s:%d", entry.AddrIPv4[0].String(), entry.Port), nil
+	case <-browseCtx.Done():
+		return "", fmt.Errorf("mdns discovery: timed out after %s", d.timeout)
+	}
+}
+
+// raceDiscoverers runs every discoverer concurrently and returns the
+// address of whichever answers first, recording the winner and elapsed
+// time in metrics.
+func raceDiscoverers(ctx context.Context, discoverers []LeaderDiscoverer, metrics *DiscoveryMetrics) (string, error) {
+	if len(discoverers) == 0 {
+		return "", fmt.Errorf("no leader discoverers configured")
+	}
+
+	type result struct {
+		addr string
+		name string
+		err  error
+	}
+
+	raceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	resultCh := make(chan result, len(discoverers))
+	start := time.Now()
+
+	for _, d := range discoverers {
+		d := d
+		go func() {
+			addr, err := d.Discover(raceCtx)
+			resultCh <- result{addr: addr, name: d.Name(), err: err}
+		}()
+	}
+
+	var lastErr error
+	for i := 0; i < len(discoverers); i++ {
+		res := <-resultCh
+		if res.err != nil {
+			lastErr = res.err
+			logrus.Infof("leader discovery: %s failed: %s", res.name, res.err)
+			continue
+		}
+
+		latency := time.Since(start)
+		metrics.record(res.name, latency)
+		logrus.Infof("leader discovery: %s won in %s", res.name, latency)
+		return res.addr, nil
+	}
+
+	return "", fmt.Errorf("leader discovery: all discoverers failed, last error: %s", lastErr)
+}
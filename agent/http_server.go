@@ -0,0 +1,74 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"golang.org/x/net/context"
+)
+
+// HTTPServer exposes the agent's local HTTP API (health checks, local
+// debug endpoints). It implements Service so the Supervisor can start and
+// stop it alongside the rest of the agent's components.
+type HTTPServer struct {
+	listenAddr string
+	agent      *Agent
+
+	server *http.Server
+}
+
+// NewHTTPServer builds an HTTPServer bound to listenAddr. agent is kept so
+// handlers can reach the rest of the agent's state.
+func NewHTTPServer(listenAddr string, agent *Agent) *HTTPServer {
+	return &HTTPServer{
+		listenAddr: listenAddr,
+		agent:      agent,
+	}
+}
+
+// Serve blocks, serving the agent's HTTP API until ctx is cancelled (via
+// Stop) or the listener fails.
+func (h *HTTPServer) Serve(ctx context.Context) error {
+	h.server = &http.Server{Addr: h.listenAddr, Handler: h.mux()}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- h.server.ListenAndServe()
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-errCh:
+		if err == http.ErrServerClosed {
+			return nil
+		}
+		return err
+	}
+}
+
+// Stop closes the HTTP server's listener and any open connections at once,
+// without waiting for in-flight requests to finish.
+func (h *HTTPServer) Stop() error {
+	if h.server == nil {
+		return nil
+	}
+	return h.server.Close()
+}
+
+func (h *HTTPServer) mux() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/debug/discovery", h.handleDiscoveryMetrics)
+	return mux
+}
+
+// handleDiscoveryMetrics surfaces DiscoveryMetrics so leader discovery
+// latency is actually observable, not just recorded.
+func (h *HTTPServer) handleDiscoveryMetrics(w http.ResponseWriter, r *http.Request) {
+	snapshot := h.agent.discoveryMetrics.Snapshot()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
@@ -0,0 +1,185 @@
+package agent
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// Service is a long-running component the Supervisor owns the lifecycle
+// of. Serve must block until ctx is cancelled or the service fails; Stop
+// asks it to wind down and is called at most once, only after ctx has been
+// cancelled. Stop can run while Serve is still in flight and has not yet
+// observed the cancellation: the Supervisor calls it to make Serve return.
+type Service interface {
+	Serve(ctx context.Context) error
+	Stop() error
+}
+
+// restartPolicy controls whether the Supervisor respawns a Service after
+// Serve returns.
+type restartPolicy int
+
+const (
+	// restartNever treats any return from Serve (including nil) as fatal
+	// for the whole supervisor: the context is cancelled and every other
+	// service is asked to stop.
+	restartNever restartPolicy = iota
+	// restartAlways treats Serve returning as a crash and respawns the
+	// service with exponential backoff, without affecting its siblings.
+	restartAlways
+)
+
+// supervisedService pairs a Service with how the Supervisor should react
+// when its Serve call returns.
+type supervisedService struct {
+	name    string
+	svc     Service
+	restart restartPolicy
+}
+
+// Supervisor runs a fixed set of services for the lifetime of a context,
+// cancelling everything on the first fatal error and aggregating whatever
+// errors were responsible.
+type Supervisor struct {
+	cancel context.CancelFunc
+
+	wg sync.WaitGroup
+
+	mu   sync.Mutex
+	errs []error
+}
+
+// NewSupervisor builds a Supervisor that derives its own cancellable
+// context from parent; cancelling it (directly, or via Stop) tears down
+// every supervised service.
+func NewSupervisor(parent context.Context) (*Supervisor, context.Context) {
+	ctx, cancel := context.WithCancel(parent)
+	return &Supervisor{cancel: cancel}, ctx
+}
+
+// Run starts every service in its own goroutine and returns immediately;
+// call Wait to block until they've all stopped.
+func (s *Supervisor) Run(ctx context.Context, services ...supervisedService) {
+	for _, sv := range services {
+		sv := sv
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.runOne(ctx, sv)
+		}()
+	}
+}
+
+func (s *Supervisor) runOne(ctx context.Context, sv supervisedService) {
+	backoff := REJOIN_BACKOFF
+
+	for {
+		done := make(chan error, 1)
+		go func() { done <- sv.svc.Serve(ctx) }()
+
+		var err error
+		select {
+		case <-ctx.Done():
+			// supervisor is shutting down: ask the service to release its
+			// resources (listeners, connections, ...) instead of waiting
+			// for Serve to notice cancellation on its own, then wait for
+			// Serve to actually return before moving on to the next
+			// service's teardown.
+			if stopErr := sv.svc.Stop(); stopErr != nil {
+				logrus.Warnf("%s stop: %v", sv.name, stopErr)
+			}
+			<-done
+			return
+		case err = <-done:
+		}
+
+		if ctx.Err() != nil {
+			// Serve returned as the context was cancelled and this select
+			// took done instead of ctx.Done: Stop it all the same.
+			if stopErr := sv.svc.Stop(); stopErr != nil {
+				logrus.Warnf("%s stop: %v", sv.name, stopErr)
+			}
+			if err != nil && sv.restart == restartNever {
+				s.fail(err)
+			}
+			return
+		}
+
+		if err != nil {
+			logrus.Warnf("%s quit, error: %v", sv.name, err)
+		} else {
+			logrus.Warnf("%s quit", sv.name)
+		}
+
+		if sv.restart == restartNever {
+			s.fail(err)
+			return
+		}
+
+		// restartAlways: back off and respawn, without taking the rest of
+		// the supervisor down with it.
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			if stopErr := sv.svc.Stop(); stopErr != nil {
+				logrus.Warnf("%s stop: %v", sv.name, stopErr)
+			}
+			return
+		case <-timer.C:
+		}
+
+		backoff *= 2
+		if backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
+
+func (s *Supervisor) fail(err error) {
+	s.mu.Lock()
+	if err != nil {
+		s.errs = append(s.errs, err)
+	}
+	s.mu.Unlock()
+	s.cancel()
+}
+
+// Stop cancels every supervised service's context and waits for them all
+// to return.
+func (s *Supervisor) Stop() {
+	s.cancel()
+	s.wg.Wait()
+}
+
+// Wait blocks until every supervised service has stopped (because the
+// context was cancelled, directly or via a fatal error), and returns the
+// aggregated errors that caused it, if any.
+func (s *Supervisor) Wait() error {
+	s.wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.errs) == 0 {
+		return nil
+	}
+	return aggregateErrors(s.errs)
+}
+
+// aggregateErrors is a minimal multi-error so callers get every failure
+// that contributed to shutdown, not just the first.
+type aggregateErrors []error
+
+func (a aggregateErrors) Error() string {
+	if len(a) == 1 {
+		return a[0].Error()
+	}
+	msg := "supervisor: multiple services failed:"
+	for _, err := range a {
+		msg += " [" + err.Error() + "]"
+	}
+	return msg
+}
@@ -0,0 +1,74 @@
+package agent
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// fakeService is a Service whose Serve behavior is supplied by the test and
+// which records how many times Stop is called.
+type fakeService struct {
+	serveFunc func(ctx context.Context) error
+	stopCalls int32
+}
+
+func (f *fakeService) Serve(ctx context.Context) error { return f.serveFunc(ctx) }
+
+func (f *fakeService) Stop() error {
+	atomic.AddInt32(&f.stopCalls, 1)
+	return nil
+}
+
+func blockUntilDone(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+func TestSupervisorFailurePropagatesAndStopsSiblings(t *testing.T) {
+	boom := errors.New("boom")
+	failing := &fakeService{serveFunc: func(context.Context) error { return boom }}
+	sibling := &fakeService{serveFunc: blockUntilDone}
+
+	sup, ctx := NewSupervisor(context.Background())
+	sup.Run(ctx,
+		supervisedService{name: "failing", svc: failing, restart: restartNever},
+		supervisedService{name: "sibling", svc: sibling, restart: restartAlways},
+	)
+
+	err := sup.Wait()
+	if err == nil || !strings.Contains(err.Error(), boom.Error()) {
+		t.Fatalf("Wait() = %v, want an error containing %q", err, boom.Error())
+	}
+
+	// the sibling was blocked on ctx, which the failing service's restartNever
+	// policy must have cancelled; its Stop should have been called once as
+	// part of that teardown.
+	if got := atomic.LoadInt32(&sibling.stopCalls); got != 1 {
+		t.Errorf("sibling Stop() called %d times, want 1", got)
+	}
+	// the failing service returned on its own before any cancellation;
+	// runOne only calls Stop once the context has been cancelled.
+	if got := atomic.LoadInt32(&failing.stopCalls); got != 0 {
+		t.Errorf("failing service Stop() called %d times, want 0", got)
+	}
+}
+
+func TestSupervisorStopTerminatesBlockedServices(t *testing.T) {
+	blocking := &fakeService{serveFunc: blockUntilDone}
+
+	sup, ctx := NewSupervisor(context.Background())
+	sup.Run(ctx, supervisedService{name: "blocking", svc: blocking, restart: restartNever})
+
+	sup.Stop()
+
+	if got := atomic.LoadInt32(&blocking.stopCalls); got != 1 {
+		t.Errorf("Stop() called %d times, want 1", got)
+	}
+	if err := sup.Wait(); err != nil {
+		t.Errorf("Wait() = %v, want nil", err)
+	}
+}
@@ -0,0 +1,257 @@
+// Package sse implements a small Server-Sent Events client following the
+// W3C EventSource grammar, with reconnection, Last-Event-ID resumption and
+// heartbeat detection. It is intentionally dependency-free so it can be
+// reused by the agent (and future consumers) without pulling in the rest
+// of swan.
+package sse
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// DefaultRetry is the reconnection delay used until the server sends a
+// `retry:` field or a previous attempt overrides it.
+const DefaultRetry = 3 * time.Second
+
+// MaxRetry caps the exponential backoff so a flaky master doesn't push the
+// agent into multi-minute silence.
+const MaxRetry = 30 * time.Second
+
+// DefaultReadTimeout bounds how long the client waits for a line (including
+// heartbeat comments) before treating the connection as dead.
+const DefaultReadTimeout = 45 * time.Second
+
+// Event is a single parsed SSE message.
+type Event struct {
+	ID    string
+	Event string
+	Data  string
+}
+
+// Client is a reconnecting SSE client. Zero value is not usable; build one
+// with NewClient.
+type Client struct {
+	URL         string
+	Header      http.Header
+	ReadTimeout time.Duration
+
+	httpClient  *http.Client
+	lastEventID string
+	retry       time.Duration
+}
+
+// NewClient builds a Client pointed at url. Extra request headers (e.g.
+// auth) can be set on the returned Client's Header before calling Run.
+func NewClient(url string) *Client {
+	return &Client{
+		URL:         url,
+		Header:      make(http.Header),
+		ReadTimeout: DefaultReadTimeout,
+		httpClient:  &http.Client{},
+		retry:       DefaultRetry,
+	}
+}
+
+// LastEventID returns the ID of the most recently received event, or "" if
+// none has been received yet. Useful for callers that persist progress
+// across process restarts.
+func (c *Client) LastEventID() string {
+	return c.lastEventID
+}
+
+// Run connects to the SSE endpoint and invokes onEvent for every event
+// received, reconnecting with exponential backoff and jitter (seeded by the
+// server-provided retry: field) until ctx is cancelled or onEvent returns a
+// non-nil error, which Run then returns without reconnecting. Heartbeat
+// comment lines (a bare ":") reset the dead-peer read timeout but are not
+// delivered to onEvent.
+func (c *Client) Run(ctx context.Context, onEvent func(Event) error) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		err := c.connectOnce(ctx, onEvent)
+		if dispatchErr, ok := err.(*dispatchError); ok {
+			return dispatchErr.err
+		}
+
+		delay := c.nextBackoff()
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// dispatchError marks an error returned by the caller's onEvent callback,
+// as opposed to a transport-level failure. Run treats it as a permanent
+// stop instead of something to retry.
+type dispatchError struct{ err error }
+
+func (d *dispatchError) Error() string { return d.err.Error() }
+
+func (c *Client) nextBackoff() time.Duration {
+	base := c.retry
+	if base <= 0 {
+		base = DefaultRetry
+	}
+	base *= 2
+	if base > MaxRetry {
+		base = MaxRetry
+	}
+	c.retry = base
+
+	jitter := time.Duration(rand.Int63n(int64(base) / 2))
+	return base/2 + jitter
+}
+
+func (c *Client) connectOnce(ctx context.Context, onEvent func(Event) error) error {
+	req, err := http.NewRequest("GET", c.URL, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	for k, v := range c.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if c.lastEventID != "" {
+		req.Header.Set("Last-Event-ID", c.lastEventID)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("sse: unexpected status %d from %s", resp.StatusCode, c.URL)
+	}
+
+	// a successful connect resets the backoff to DefaultRetry; a retry:
+	// field on this stream then replaces it, but a value announced on an
+	// earlier connection is not kept.
+	c.retry = DefaultRetry
+
+	return c.decode(resp.Body, onEvent)
+}
+
+// decode parses the event stream per the EventSource grammar: a block of
+// field lines terminated by a blank line forms one event; multiple data:
+// lines are joined with "\n"; lines starting with ":" are comments/heartbeats.
+func (c *Client) decode(body io.Reader, onEvent func(Event) error) error {
+	reader := bufio.NewReader(&deadlineReader{r: body, timeout: c.ReadTimeout})
+
+	var (
+		dataLines []string
+		eventType string
+		eventID   string
+	)
+
+	flush := func() error {
+		if len(dataLines) == 0 && eventType == "" && eventID == "" {
+			return nil
+		}
+		if len(dataLines) == 0 {
+			// a field block with no data: line (e.g. a bare id: before the
+			// connection dropped) was never delivered, so it must not move
+			// lastEventID forward either.
+			eventType, eventID = "", ""
+			return nil
+		}
+
+		evt := Event{
+			ID:    eventID,
+			Event: eventType,
+			Data:  strings.Join(dataLines, "\n"),
+		}
+		dataLines, eventType, eventID = nil, "", ""
+
+		if err := onEvent(evt); err != nil {
+			return &dispatchError{err: err}
+		}
+		// only advance lastEventID once the event has actually been
+		// delivered, so a connection that drops mid-flush resumes from the
+		// last event the caller really saw, not one it never got.
+		if evt.ID != "" {
+			c.lastEventID = evt.ID
+		}
+		return nil
+	}
+
+	for {
+		line, err := reader.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case line == "":
+			if ferr := flush(); ferr != nil {
+				return ferr
+			}
+		case strings.HasPrefix(line, ":"):
+			// comment / heartbeat: liveness only, no payload.
+		case strings.HasPrefix(line, "data:"):
+			dataLines = append(dataLines, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		case strings.HasPrefix(line, "event:"):
+			eventType = strings.TrimPrefix(strings.TrimPrefix(line, "event:"), " ")
+		case strings.HasPrefix(line, "id:"):
+			eventID = strings.TrimPrefix(strings.TrimPrefix(line, "id:"), " ")
+		case strings.HasPrefix(line, "retry:"):
+			if ms, perr := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "retry:"))); perr == nil {
+				c.retry = time.Duration(ms) * time.Millisecond
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// deadlineReader fails a Read that takes longer than timeout to produce
+// data, so a master that stops sending even heartbeat comments is detected
+// as dead instead of hanging the agent forever.
+type deadlineReader struct {
+	r       io.Reader
+	timeout time.Duration
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	if d.timeout <= 0 {
+		return d.r.Read(p)
+	}
+
+	type result struct {
+		n   int
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		n, err := d.r.Read(p)
+		ch <- result{n, err}
+	}()
+
+	select {
+	case res := <-ch:
+		return res.n, res.err
+	case <-time.After(d.timeout):
+		return 0, fmt.Errorf("sse: read timeout after %s, master connection presumed dead", d.timeout)
+	}
+}
@@ -0,0 +1,110 @@
+package sse
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDecodeParsesEvents(t *testing.T) {
+	input := "id:1\nevent:foo\ndata:hello\n\nid:2\nevent:foo\ndata:world\n\n"
+
+	c := &Client{}
+	var got []Event
+	var lastEventIDDuringCallback []string
+
+	err := c.decode(strings.NewReader(input), func(evt Event) error {
+		got = append(got, evt)
+		lastEventIDDuringCallback = append(lastEventIDDuringCallback, c.LastEventID())
+		return nil
+	})
+	if err == nil || err.Error() != "EOF" {
+		t.Fatalf("expected EOF once the reader is exhausted, got %v", err)
+	}
+
+	want := []Event{
+		{ID: "1", Event: "foo", Data: "hello"},
+		{ID: "2", Event: "foo", Data: "world"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d events, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("event %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	// LastEventID() isn't advanced to the event currently being delivered
+	// until after the callback returns, so callers must read the event's
+	// own ID from the callback argument rather than LastEventID().
+	if lastEventIDDuringCallback[0] != "" {
+		t.Errorf("LastEventID() during first callback = %q, want empty", lastEventIDDuringCallback[0])
+	}
+	if lastEventIDDuringCallback[1] != "1" {
+		t.Errorf("LastEventID() during second callback = %q, want %q (the previous event)", lastEventIDDuringCallback[1], "1")
+	}
+	if c.LastEventID() != "2" {
+		t.Errorf("LastEventID() after decode = %q, want %q", c.LastEventID(), "2")
+	}
+}
+
+func TestDecodeSkipsUndeliveredPartialEvent(t *testing.T) {
+	// a bare id: line with no data: line never forms a deliverable event,
+	// and must not move lastEventID forward.
+	input := "id:1\n\n"
+
+	c := &Client{}
+	called := false
+	err := c.decode(strings.NewReader(input), func(Event) error {
+		called = true
+		return nil
+	})
+	if err == nil || err.Error() != "EOF" {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	if called {
+		t.Error("onEvent should not be called for a field block with no data")
+	}
+	if c.LastEventID() != "" {
+		t.Errorf("LastEventID() = %q, want empty", c.LastEventID())
+	}
+}
+
+func TestDecodeIgnoresHeartbeatComments(t *testing.T) {
+	input := ":keepalive\nid:1\ndata:hi\n\n"
+
+	c := &Client{}
+	var got []Event
+	c.decode(strings.NewReader(input), func(evt Event) error {
+		got = append(got, evt)
+		return nil
+	})
+
+	if len(got) != 1 || got[0].Data != "hi" {
+		t.Fatalf("got %+v, want one event with data %q", got, "hi")
+	}
+}
+
+func TestDecodeStopsOnOnEventError(t *testing.T) {
+	input := "data:hello\n\ndata:world\n\n"
+	boom := errors.New("boom")
+
+	c := &Client{}
+	var delivered int
+	err := c.decode(strings.NewReader(input), func(Event) error {
+		delivered++
+		return boom
+	})
+
+	de, ok := err.(*dispatchError)
+	if !ok {
+		t.Fatalf("decode returned %T, want *dispatchError", err)
+	}
+	if de.err != boom {
+		t.Errorf("dispatchError wraps %v, want %v", de.err, boom)
+	}
+	if delivered != 1 {
+		t.Errorf("onEvent called %d times, want 1 (decode must stop on first error)", delivered)
+	}
+}
@@ -0,0 +1,92 @@
+package janitor
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TrustedProxies is a set of CIDRs describing upstream load balancers
+// (ELB, nginx, Cloudflare, ...) the janitor sits behind. Requests whose
+// immediate peer falls inside one of these are allowed to tell the
+// janitor what the real client IP is, via X-Forwarded-For/X-Real-IP or an
+// inbound PROXY protocol header; anything else is not trusted and its
+// RemoteAddr is taken at face value.
+type TrustedProxies struct {
+	nets []*net.IPNet
+}
+
+// NewTrustedProxies parses cidrs (as configured via config.Janitor) into a
+// TrustedProxies set. Malformed entries are skipped rather than failing
+// the whole janitor, since a single typo in an operator's config shouldn't
+// take the gateway down.
+func NewTrustedProxies(cidrs []string) *TrustedProxies {
+	t := &TrustedProxies{}
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			continue
+		}
+		t.nets = append(t.nets, ipNet)
+	}
+	return t
+}
+
+// Contains reports whether ip falls inside any configured trusted CIDR.
+func (t *TrustedProxies) Contains(ip net.IP) bool {
+	for _, ipNet := range t.nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveClientIP picks the real client IP for r: it walks
+// X-Forwarded-For right-to-left, skipping addresses that fall inside a
+// trusted proxy CIDR, and stops at the first untrusted hop (that hop is
+// the real client, since anything past it could have been injected by an
+// untrusted party). X-Real-IP is honored only when the immediate peer is
+// itself trusted and no usable X-Forwarded-For was present; otherwise the
+// immediate peer (RemoteAddr) is used as-is.
+func (t *TrustedProxies) ResolveClientIP(r *http.Request) string {
+	peerHost, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peerHost = r.RemoteAddr
+	}
+	peerIP := net.ParseIP(peerHost)
+	peerTrusted := peerIP != nil && t.Contains(peerIP)
+
+	// if the peer itself isn't trusted, nothing in X-Forwarded-For can be.
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" && peerTrusted {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			ip := net.ParseIP(hop)
+			if ip == nil {
+				continue
+			}
+			if t.Contains(ip) {
+				continue
+			}
+			return hop
+		}
+	}
+
+	if peerTrusted {
+		if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+			return realIP
+		}
+	}
+
+	return peerHost
+}
+
+// ApplyClientIP resolves r's real client IP and sets the canonical
+// X-Real-IP header to it, so both the upstream backend and access logs
+// see the same trusted value instead of re-deriving it independently.
+func (t *TrustedProxies) ApplyClientIP(r *http.Request) string {
+	clientIP := t.ResolveClientIP(r)
+	r.Header.Set("X-Real-IP", clientIP)
+	return clientIP
+}
@@ -0,0 +1,89 @@
+package janitor
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func newRequest(remoteAddr, xff, xRealIP string) *http.Request {
+	r := &http.Request{Header: make(http.Header), RemoteAddr: remoteAddr}
+	if xff != "" {
+		r.Header.Set("X-Forwarded-For", xff)
+	}
+	if xRealIP != "" {
+		r.Header.Set("X-Real-IP", xRealIP)
+	}
+	return r
+}
+
+func TestResolveClientIP(t *testing.T) {
+	trusted := NewTrustedProxies([]string{"10.0.0.0/8"})
+
+	cases := []struct {
+		name       string
+		remoteAddr string
+		xff        string
+		xRealIP    string
+		want       string
+	}{
+		{
+			name:       "untrusted peer ignores X-Forwarded-For",
+			remoteAddr: "203.0.113.5:1234",
+			xff:        "198.51.100.9",
+			want:       "203.0.113.5",
+		},
+		{
+			name:       "trusted peer, XFF walked back to first untrusted hop",
+			remoteAddr: "10.0.0.1:1234",
+			xff:        "198.51.100.9, 10.0.0.1",
+			want:       "198.51.100.9",
+		},
+		{
+			name:       "trusted peer, multi-hop XFF skips every trusted hop",
+			remoteAddr: "10.0.0.2:1234",
+			xff:        "198.51.100.9, 10.0.0.1, 10.0.0.2",
+			want:       "198.51.100.9",
+		},
+		{
+			name:       "trusted peer, no XFF falls back to X-Real-IP",
+			remoteAddr: "10.0.0.1:1234",
+			xRealIP:    "198.51.100.9",
+			want:       "198.51.100.9",
+		},
+		{
+			name:       "trusted peer, no XFF or X-Real-IP falls back to peer",
+			remoteAddr: "10.0.0.1:1234",
+			want:       "10.0.0.1",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := trusted.ResolveClientIP(newRequest(tc.remoteAddr, tc.xff, tc.xRealIP))
+			if got != tc.want {
+				t.Errorf("ResolveClientIP() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTrustedProxiesContains(t *testing.T) {
+	trusted := NewTrustedProxies([]string{"10.0.0.0/8", "not-a-cidr"})
+
+	if !trusted.Contains(mustParseIP(t, "10.1.2.3")) {
+		t.Error("expected 10.1.2.3 to be trusted")
+	}
+	if trusted.Contains(mustParseIP(t, "192.168.1.1")) {
+		t.Error("expected 192.168.1.1 not to be trusted")
+	}
+}
+
+func mustParseIP(t *testing.T, s string) net.IP {
+	t.Helper()
+	ip := net.ParseIP(s)
+	if ip == nil {
+		t.Fatalf("ParseIP(%q) failed", s)
+	}
+	return ip
+}
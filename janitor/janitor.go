@@ -0,0 +1,179 @@
+// Package janitor is swan's embedded reverse-proxy gateway: it keeps a
+// live registry of backends per upstream (fed by Agent.dispatchEvents via
+// EmitEvent) and proxies HTTP requests to them.
+package janitor
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+
+	"github.com/Dataman-Cloud/swan/src/config"
+	"github.com/Dataman-Cloud/swan/src/janitor/upstream"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// JanitorServer is the gateway's HTTP entrypoint: it routes each request
+// to one of its upstream's registered backends, honoring per-backend PROXY
+// protocol settings and trusted-proxy client IP resolution, while
+// exposing a live traffic/connections/logs view via TrafficController.
+type JanitorServer struct {
+	config         *config.Janitor
+	traffic        *TrafficController
+	trustedProxies *TrustedProxies
+
+	mu       sync.RWMutex
+	backends map[string][]*upstream.Backend // keyed by upstream ID
+
+	httpServer *http.Server
+}
+
+// NewJanitorServer builds a JanitorServer from conf. It has no backends
+// and isn't listening until Start (or Serve) is called.
+func NewJanitorServer(conf *config.Janitor) *JanitorServer {
+	return &JanitorServer{
+		config:         conf,
+		traffic:        NewTrafficController(conf.TrafficListenAddr),
+		trustedProxies: NewTrustedProxies(conf.TrustedProxies),
+		backends:       make(map[string][]*upstream.Backend),
+	}
+}
+
+// EmitEvent applies a backend add/del/change event to the registry, as
+// produced by agent.genJanitorBackendEvent from master task events.
+func (j *JanitorServer) EmitEvent(evt *upstream.BackendEvent) {
+	if evt == nil || evt.Upstream == nil || evt.Backend == nil {
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	ups := evt.Upstream.ID
+	switch evt.Action {
+	case "add":
+		j.backends[ups] = append(j.backends[ups], evt.Backend)
+	case "del":
+		backends := j.backends[ups]
+		for i, b := range backends {
+			if b.ID == evt.Backend.ID {
+				j.backends[ups] = append(backends[:i], backends[i+1:]...)
+				break
+			}
+		}
+	case "change":
+		for _, b := range j.backends[ups] {
+			if b.ID == evt.Backend.ID {
+				b.Weight = evt.Backend.Weight
+				b.ProxyProtocol = evt.Backend.ProxyProtocol
+				break
+			}
+		}
+	}
+}
+
+func (j *JanitorServer) pickBackend(upstreamID string) (*upstream.Backend, error) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	backends := j.backends[upstreamID]
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("janitor: no backend registered for upstream %s", upstreamID)
+	}
+	// TODO: weighted selection using Backend.Weight; random is a
+	// placeholder until the balancer gets its own pass.
+	return backends[rand.Intn(len(backends))], nil
+}
+
+// Start brings up the traffic controller and the reverse-proxy listener,
+// blocking until the listener fails or is closed by Stop.
+func (j *JanitorServer) Start() error {
+	go func() {
+		if err := j.traffic.Start(); err != nil {
+			logrus.Warnf("janitor traffic controller quit: %v", err)
+		}
+	}()
+
+	ln, err := net.Listen("tcp", j.config.ListenAddr)
+	if err != nil {
+		return err
+	}
+	ln = &proxyProtoListener{Listener: ln, enabled: j.config.EnableProxyProtocol, trusted: j.trustedProxies}
+
+	j.httpServer = &http.Server{Handler: http.HandlerFunc(j.handleProxy)}
+	logrus.Infof("janitor listening on %s", j.config.ListenAddr)
+	return j.httpServer.Serve(ln)
+}
+
+// Serve implements agent.Service: it runs Start until ctx is cancelled.
+func (j *JanitorServer) Serve(ctx context.Context) error {
+	errCh := make(chan error, 1)
+	go func() { errCh <- j.Start() }()
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-errCh:
+		if err == http.ErrServerClosed {
+			return nil
+		}
+		return err
+	}
+}
+
+// Stop implements agent.Service: it closes the reverse-proxy listener and
+// the traffic controller's own listener/sampleLoop, so nothing is left
+// running once the janitor service is reported stopped.
+func (j *JanitorServer) Stop() error {
+	j.traffic.Stop()
+
+	if j.httpServer != nil {
+		return j.httpServer.Close()
+	}
+	return nil
+}
+
+// handleProxy routes r to one of r.Host's registered backends. The real
+// client IP (walking X-Forwarded-For past any trusted proxy hop, or the
+// PROXY-protocol-derived RemoteAddr set by proxyProtoListener) is resolved
+// once, stamped onto X-Real-IP for the backend and access logs, and reused
+// as the address the PROXY protocol header to the backend describes.
+func (j *JanitorServer) handleProxy(w http.ResponseWriter, r *http.Request) {
+	upstreamID := r.Host
+	clientIP := j.trustedProxies.ApplyClientIP(r)
+
+	backend, err := j.pickBackend(upstreamID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	accessLog := fmt.Sprintf("janitor: %s %s -> upstream=%s backend=%s", clientIP, r.URL.Path, upstreamID, backend.ID)
+	logrus.Info(accessLog)
+	j.traffic.PublishLog([]byte(accessLog))
+
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "http"
+			req.URL.Host = fmt.Sprintf("%s:%d", backend.IP, backend.Port)
+		},
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				clientAddr := &net.TCPAddr{IP: net.ParseIP(clientIP)}
+
+				conn, err := upstream.DialBackend(addr, clientAddr, backend)
+				if err != nil {
+					return nil, err
+				}
+				return j.traffic.Track(conn, upstreamID, backend.ID, clientIP), nil
+			},
+		},
+	}
+
+	proxy.ServeHTTP(w, r)
+}
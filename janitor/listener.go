@@ -0,0 +1,89 @@
+package janitor
+
+import (
+	"bufio"
+	"net"
+
+	"github.com/Dataman-Cloud/swan/src/janitor/upstream"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// proxyProtoListener accepts an inbound v1/v2 PROXY protocol header ahead
+// of the proxied stream, on listeners explicitly opted into speaking it
+// (enabled) and only for peers inside the configured TrustedProxies CIDRs
+// — an untrusted peer could otherwise trivially spoof its own "real"
+// client address. This is independent of TrustedProxies' other use
+// (trusting X-Forwarded-For/X-Real-IP), which doesn't imply the peer also
+// sends a PROXY protocol preamble: the common ELB/nginx case trusts XFF
+// but never speaks PROXY protocol.
+type proxyProtoListener struct {
+	net.Listener
+	enabled bool
+	trusted *TrustedProxies
+}
+
+// Accept never fails the listener over a single bad or missing header: a
+// connection that sends a malformed PROXY header is simply dropped and
+// Accept moves on to the next connection, while one that sends no PROXY
+// header at all is passed through as an ordinary connection, so one stray
+// non-conforming client can't take the whole gateway down.
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if !l.enabled {
+			return conn, nil
+		}
+
+		tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+		if !ok || !l.trusted.Contains(tcpAddr.IP) {
+			return conn, nil
+		}
+
+		br := bufio.NewReader(conn)
+		realAddr, found, err := upstream.PeekProxyHeader(br)
+		if err != nil {
+			logrus.Warnf("janitor: trusted peer %s sent a malformed PROXY header, dropping connection: %s", tcpAddr, err)
+			conn.Close()
+			continue
+		}
+		if !found {
+			// no PROXY preamble on this connection; nothing was consumed
+			// from the stream beyond buffering, so carry on as normal.
+			return &bufferedConn{Conn: conn, r: br}, nil
+		}
+		if realAddr == nil {
+			// a valid LOCAL/health-check frame: header consumed, no
+			// address to translate.
+			return &bufferedConn{Conn: conn, r: br}, nil
+		}
+
+		return &proxyProtoConn{Conn: conn, r: br, realAddr: realAddr}, nil
+	}
+}
+
+// bufferedConn wraps a conn whose first bytes were already buffered into
+// r (e.g. while peeking for a PROXY header that turned out absent), so
+// those bytes aren't lost to the next reader.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// proxyProtoConn wraps an accepted conn whose leading PROXY protocol
+// header has already been consumed into br, reporting the original
+// client's address instead of the immediate (trusted proxy) peer's.
+type proxyProtoConn struct {
+	net.Conn
+	r        *bufio.Reader
+	realAddr net.Addr
+}
+
+func (c *proxyProtoConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+func (c *proxyProtoConn) RemoteAddr() net.Addr       { return c.realAddr }
@@ -0,0 +1,347 @@
+package janitor
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/websocket"
+	"github.com/satori/go.uuid"
+)
+
+// TrafficController exposes a clash-style live view of gateway traffic:
+// instantaneous up/down throughput, the list of active proxied connections
+// and a tail of the janitor's access/error logs. It is mounted as its own
+// HTTP server so operators don't need external Prometheus scraping just to
+// see what's flowing through the gateway right now.
+type TrafficController struct {
+	listenAddr string
+
+	mu    sync.Mutex
+	conns map[string]*trackedConn
+
+	upBytes   int64 // bytes written to backends in the current second
+	downBytes int64 // bytes read from backends in the current second
+
+	trafficSubsMu sync.Mutex
+	trafficSubs   map[chan []byte]struct{}
+
+	logSubsMu sync.Mutex
+	logSubs   map[chan []byte]struct{}
+
+	upgrader websocket.Upgrader
+	server   *http.Server
+	stopCh   chan struct{}
+}
+
+// trackedConn is a proxied connection registered with the controller so it
+// shows up in /connections and contributes to /traffic counters.
+type trackedConn struct {
+	net.Conn
+
+	id       string
+	upstream string
+	backend  string
+	remote   string
+	start    time.Time
+
+	txBytes int64
+	rxBytes int64
+
+	ctrl *TrafficController
+}
+
+func (c *trackedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		atomic.AddInt64(&c.rxBytes, int64(n))
+		atomic.AddInt64(&c.ctrl.downBytes, int64(n))
+	}
+	return n, err
+}
+
+func (c *trackedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		atomic.AddInt64(&c.txBytes, int64(n))
+		atomic.AddInt64(&c.ctrl.upBytes, int64(n))
+	}
+	return n, err
+}
+
+func (c *trackedConn) Close() error {
+	c.ctrl.untrack(c.id)
+	return c.Conn.Close()
+}
+
+// connSnapshot is the JSON shape returned by GET /connections.
+type connSnapshot struct {
+	ID         string    `json:"id"`
+	Upstream   string    `json:"upstream"`
+	Backend    string    `json:"backend"`
+	RemoteAddr string    `json:"remoteAddr"`
+	Start      time.Time `json:"start"`
+	TxBytes    int64     `json:"txBytes"`
+	RxBytes    int64     `json:"rxBytes"`
+}
+
+// trafficSample is one line of the /traffic stream.
+type trafficSample struct {
+	Up   int64 `json:"up"`
+	Down int64 `json:"down"`
+}
+
+// NewTrafficController builds a controller that will listen on listenAddr
+// once Start is called. An empty listenAddr disables the feature.
+func NewTrafficController(listenAddr string) *TrafficController {
+	return &TrafficController{
+		listenAddr:  listenAddr,
+		conns:       make(map[string]*trackedConn),
+		trafficSubs: make(map[chan []byte]struct{}),
+		logSubs:     make(map[chan []byte]struct{}),
+		upgrader:    websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }},
+		stopCh:      make(chan struct{}),
+	}
+}
+
+// Start brings up the traffic HTTP+WS mux. It is a no-op if no listen
+// address was configured.
+func (t *TrafficController) Start() error {
+	if t.listenAddr == "" {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/traffic", t.handleTraffic)
+	mux.HandleFunc("/connections", t.handleConnections)
+	mux.HandleFunc("/logs", t.handleLogs)
+
+	t.server = &http.Server{Addr: t.listenAddr, Handler: mux}
+
+	go t.sampleLoop()
+
+	logrus.Infof("janitor traffic controller listening on %s", t.listenAddr)
+	err := t.server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Stop tears down the traffic HTTP server and its sampleLoop goroutine. It
+// is a no-op if the controller was never started (empty listenAddr).
+func (t *TrafficController) Stop() error {
+	close(t.stopCh)
+	if t.server != nil {
+		return t.server.Close()
+	}
+	return nil
+}
+
+// Track wraps conn so its byte counts feed /traffic and it shows up in
+// /connections until it is closed or forcibly killed via DELETE. remoteAddr
+// is the real client address (already resolved via TrustedProxies), not
+// conn's own RemoteAddr() — conn here is the backend dial connection, whose
+// address would just duplicate the backend field.
+func (t *TrafficController) Track(conn net.Conn, upstream, backend, remoteAddr string) net.Conn {
+	id := uuid.NewV4().String()
+	tc := &trackedConn{
+		Conn:     conn,
+		id:       id,
+		upstream: upstream,
+		backend:  backend,
+		remote:   remoteAddr,
+		start:    time.Now(),
+		ctrl:     t,
+	}
+
+	t.mu.Lock()
+	t.conns[id] = tc
+	t.mu.Unlock()
+
+	return tc
+}
+
+func (t *TrafficController) untrack(id string) {
+	t.mu.Lock()
+	delete(t.conns, id)
+	t.mu.Unlock()
+}
+
+// PublishLog fans a formatted access/error log line out to every /logs
+// subscriber currently connected. Non-blocking: a slow subscriber drops
+// lines rather than stalling the proxy path.
+func (t *TrafficController) PublishLog(line []byte) {
+	t.logSubsMu.Lock()
+	defer t.logSubsMu.Unlock()
+
+	for ch := range t.logSubs {
+		select {
+		case ch <- line:
+		default:
+		}
+	}
+}
+
+func (t *TrafficController) sampleLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.stopCh:
+			return
+		case <-ticker.C:
+			up := atomic.SwapInt64(&t.upBytes, 0)
+			down := atomic.SwapInt64(&t.downBytes, 0)
+
+			t.broadcastSample(trafficSample{Up: up, Down: down})
+		}
+	}
+}
+
+func (t *TrafficController) broadcastSample(sample trafficSample) {
+	b, err := json.Marshal(sample)
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+
+	t.trafficSubsMu.Lock()
+	defer t.trafficSubsMu.Unlock()
+	for ch := range t.trafficSubs {
+		select {
+		case ch <- b:
+		default:
+		}
+	}
+}
+
+// handleTraffic streams one JSON line per second of {up,down} byte counts,
+// either as a websocket or as chunked HTTP for clients that can't upgrade.
+func (t *TrafficController) handleTraffic(w http.ResponseWriter, r *http.Request) {
+	ch := make(chan []byte, 16)
+	t.trafficSubsMu.Lock()
+	t.trafficSubs[ch] = struct{}{}
+	t.trafficSubsMu.Unlock()
+	defer func() {
+		t.trafficSubsMu.Lock()
+		delete(t.trafficSubs, ch)
+		t.trafficSubsMu.Unlock()
+	}()
+
+	if websocket.IsWebSocketUpgrade(r) {
+		conn, err := t.upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		for line := range ch {
+			if err := conn.WriteMessage(websocket.TextMessage, line); err != nil {
+				return
+			}
+		}
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	for line := range ch {
+		if _, err := w.Write(line); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// handleConnections lists active proxied connections (GET) or kills one by
+// id (DELETE ?id=...).
+func (t *TrafficController) handleConnections(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		t.mu.Lock()
+		snapshots := make([]connSnapshot, 0, len(t.conns))
+		for _, c := range t.conns {
+			snapshots = append(snapshots, connSnapshot{
+				ID:         c.id,
+				Upstream:   c.upstream,
+				Backend:    c.backend,
+				RemoteAddr: c.remote,
+				Start:      c.start,
+				TxBytes:    atomic.LoadInt64(&c.txBytes),
+				RxBytes:    atomic.LoadInt64(&c.rxBytes),
+			})
+		}
+		t.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(snapshots)
+
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		t.mu.Lock()
+		conn, ok := t.conns[id]
+		t.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		conn.Close()
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleLogs streams janitor access/error log lines as they are published
+// via PublishLog, over the same websocket-or-chunked-HTTP mechanics as
+// /traffic.
+func (t *TrafficController) handleLogs(w http.ResponseWriter, r *http.Request) {
+	ch := make(chan []byte, 64)
+	t.logSubsMu.Lock()
+	t.logSubs[ch] = struct{}{}
+	t.logSubsMu.Unlock()
+	defer func() {
+		t.logSubsMu.Lock()
+		delete(t.logSubs, ch)
+		t.logSubsMu.Unlock()
+	}()
+
+	if websocket.IsWebSocketUpgrade(r) {
+		conn, err := t.upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		for line := range ch {
+			if err := conn.WriteMessage(websocket.TextMessage, line); err != nil {
+				return
+			}
+		}
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	for line := range ch {
+		if _, err := w.Write(line); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,52 @@
+package upstream
+
+// BackendEvent carries everything the janitor needs to add, remove or
+// reweight a single backend behind an upstream.
+type BackendEvent struct {
+	Action   string // "add", "del" or "change"
+	Upstream *Upstream
+	Backend  *Backend
+}
+
+// Upstream identifies the logical service a backend belongs to.
+type Upstream struct {
+	ID     string
+	Alias  string
+	Listen string
+}
+
+// Backend is one concrete (ip, port) instance of an upstream.
+type Backend struct {
+	ID      string
+	IP      string
+	Port    int
+	Weight  float64
+	Version string
+
+	// ProxyProtocol selects the PROXY protocol version (1 or 2) the
+	// janitor should prepend when dialing this backend, or 0 to disable
+	// it. Set from types.TaskInfoEvent.ProxyProtocol via
+	// genJanitorBackendEvent so operators can opt in per-app.
+	ProxyProtocol int
+}
+
+// BuildBackendEvent assembles a BackendEvent for act ("add", "del",
+// "change") on the given upstream/backend pair.
+func BuildBackendEvent(act, ups, alias, listen, backend, ip, version string, port int, weight float64, proxyProtocol int) *BackendEvent {
+	return &BackendEvent{
+		Action: act,
+		Upstream: &Upstream{
+			ID:     ups,
+			Alias:  alias,
+			Listen: listen,
+		},
+		Backend: &Backend{
+			ID:            backend,
+			IP:            ip,
+			Port:          port,
+			Weight:        weight,
+			Version:       version,
+			ProxyProtocol: proxyProtocol,
+		},
+	}
+}
@@ -0,0 +1,238 @@
+package upstream
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// proxyProtoV2Signature is the fixed 12-byte magic that opens every PROXY
+// protocol v2 header.
+var proxyProtoV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// WriteProxyHeader writes a PROXY protocol header describing the original
+// client (clientAddr) ahead of the proxied stream on conn, so the backend
+// can recover the real client IP/port instead of seeing the janitor's own
+// address. version must be 1 (human-readable text) or 2 (binary); 0
+// writes nothing.
+func WriteProxyHeader(conn net.Conn, clientAddr, backendAddr net.Addr, version int) error {
+	switch version {
+	case 1:
+		return writeProxyHeaderV1(conn, clientAddr, backendAddr)
+	case 2:
+		return writeProxyHeaderV2(conn, clientAddr, backendAddr)
+	case 0:
+		return nil
+	default:
+		return fmt.Errorf("upstream: unsupported PROXY protocol version %d", version)
+	}
+}
+
+func writeProxyHeaderV1(conn net.Conn, clientAddr, backendAddr net.Addr) error {
+	srcHost, srcPort, family, err := splitAddr(clientAddr)
+	if err != nil {
+		return err
+	}
+	dstHost, dstPort, _, err := splitAddr(backendAddr)
+	if err != nil {
+		return err
+	}
+
+	header := fmt.Sprintf("PROXY %s %s %s %s %s\r\n", family, srcHost, dstHost, srcPort, dstPort)
+	_, err = conn.Write([]byte(header))
+	return err
+}
+
+func writeProxyHeaderV2(conn net.Conn, clientAddr, backendAddr net.Addr) error {
+	srcHost, srcPort, family, err := splitAddr(clientAddr)
+	if err != nil {
+		return err
+	}
+	dstHost, dstPort, _, err := splitAddr(backendAddr)
+	if err != nil {
+		return err
+	}
+
+	srcIP := net.ParseIP(srcHost)
+	dstIP := net.ParseIP(dstHost)
+
+	var buf bytes.Buffer
+	buf.Write(proxyProtoV2Signature)
+	buf.WriteByte(0x21) // version 2, PROXY command
+
+	var addrFamily byte
+	var addrLen uint16
+	switch family {
+	case "TCP4":
+		addrFamily = 0x11 // AF_INET, STREAM
+		addrLen = 12       // 4+4+2+2
+	case "TCP6":
+		addrFamily = 0x21 // AF_INET6, STREAM
+		addrLen = 36       // 16+16+2+2
+	default:
+		return fmt.Errorf("upstream: unsupported address family %s for PROXY v2", family)
+	}
+	buf.WriteByte(addrFamily)
+	binary.Write(&buf, binary.BigEndian, addrLen)
+
+	if family == "TCP4" {
+		buf.Write(srcIP.To4())
+		buf.Write(dstIP.To4())
+	} else {
+		buf.Write(srcIP.To16())
+		buf.Write(dstIP.To16())
+	}
+	binary.Write(&buf, binary.BigEndian, mustPort(srcPort))
+	binary.Write(&buf, binary.BigEndian, mustPort(dstPort))
+
+	_, err = conn.Write(buf.Bytes())
+	return err
+}
+
+func splitAddr(addr net.Addr) (host, port, family string, err error) {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return "", "", "", fmt.Errorf("upstream: expected *net.TCPAddr, got %T", addr)
+	}
+
+	family = "TCP4"
+	if tcpAddr.IP.To4() == nil {
+		family = "TCP6"
+	}
+	return tcpAddr.IP.String(), fmt.Sprintf("%d", tcpAddr.Port), family, nil
+}
+
+func mustPort(s string) uint16 {
+	var p uint16
+	fmt.Sscanf(s, "%d", &p)
+	return p
+}
+
+// proxyProtoV1Prefix is the literal that opens every PROXY protocol v1
+// header; used to recognize one without consuming non-header bytes.
+var proxyProtoV1Prefix = []byte("PROXY ")
+
+// PeekProxyHeader looks for a v1 or v2 PROXY protocol header at the front
+// of r without disturbing the stream when one isn't present: ok is false
+// and err is nil if r doesn't start with either signature, so callers can
+// fall back to treating the connection as an ordinary one. When a
+// signature *is* found, PeekProxyHeader consumes it and returns ok=true;
+// err is then set only if the header itself was malformed. addr is nil
+// when a v2 LOCAL (health-check) frame is found — a valid header carrying
+// no address to translate.
+func PeekProxyHeader(r *bufio.Reader) (addr net.Addr, ok bool, err error) {
+	if v2, peekErr := r.Peek(len(proxyProtoV2Signature)); peekErr == nil && bytes.Equal(v2, proxyProtoV2Signature) {
+		addr, err = readProxyHeaderV2(r)
+		return addr, true, err
+	}
+
+	if v1, peekErr := r.Peek(len(proxyProtoV1Prefix)); peekErr == nil && bytes.Equal(v1, proxyProtoV1Prefix) {
+		addr, err = readProxyHeaderV1(r)
+		return addr, true, err
+	}
+
+	return nil, false, nil
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("upstream: reading PROXY v1 header: %s", err)
+	}
+	fields := strings.Fields(strings.TrimSpace(line))
+	// PROXY <family> <src-ip> <dst-ip> <src-port> <dst-port>
+	if len(fields) != 6 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("upstream: malformed PROXY v1 header: %q", line)
+	}
+
+	port, err := strconv.Atoi(fields[4])
+	if err != nil {
+		return nil, fmt.Errorf("upstream: malformed PROXY v1 source port: %q", fields[4])
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, fmt.Errorf("upstream: malformed PROXY v1 source ip: %q", fields[2])
+	}
+
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := readFull(r, header); err != nil {
+		return nil, fmt.Errorf("upstream: reading PROXY v2 header: %s", err)
+	}
+
+	addrLen := binary.BigEndian.Uint16(header[14:16])
+	body := make([]byte, addrLen)
+	if _, err := readFull(r, body); err != nil {
+		return nil, fmt.Errorf("upstream: reading PROXY v2 address block: %s", err)
+	}
+
+	if header[12]&0x0F == 0x00 {
+		// LOCAL command: any address block is ignored.
+		return nil, nil
+	}
+
+	family := header[13]
+	switch family {
+	case 0x00:
+		// AF_UNSPEC: a PROXY-command frame that carries no client address
+		// to translate. The header is still valid and fully consumed; the
+		// caller should just proceed with the connection's own peer addr.
+		return nil, nil
+	case 0x11: // AF_INET, STREAM
+		if len(body) < 12 {
+			return nil, fmt.Errorf("upstream: short PROXY v2 ipv4 address block")
+		}
+		ip := net.IP(body[0:4])
+		port := binary.BigEndian.Uint16(body[8:10])
+		return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+	case 0x21: // AF_INET6, STREAM
+		if len(body) < 36 {
+			return nil, fmt.Errorf("upstream: short PROXY v2 ipv6 address block")
+		}
+		ip := net.IP(body[0:16])
+		port := binary.BigEndian.Uint16(body[32:34])
+		return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+	default:
+		return nil, fmt.Errorf("upstream: unsupported PROXY v2 address family %#x", family)
+	}
+}
+
+func readFull(r *bufio.Reader, buf []byte) (int, error) {
+	n := 0
+	for n < len(buf) {
+		m, err := r.Read(buf[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// DialBackend opens a TCP connection to addr and, when backend.ProxyProtocol
+// is non-zero, immediately writes a PROXY protocol header describing
+// clientAddr (the original client, taken from the inbound accepted
+// connection, or from an inbound PROXY header when the janitor itself sits
+// behind another LB) before any proxied bytes are written.
+func DialBackend(addr string, clientAddr net.Addr, backend *Backend) (net.Conn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if backend.ProxyProtocol != 0 {
+		if err := WriteProxyHeader(conn, clientAddr, conn.RemoteAddr(), backend.ProxyProtocol); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,117 @@
+package upstream
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeConn lets writeProxyHeaderV1/V2 be exercised without a real socket.
+type fakeConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *fakeConn) Write(p []byte) (int, error) { return c.buf.Write(p) }
+
+func TestWriteProxyHeaderV1RoundTrip(t *testing.T) {
+	client := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 51234}
+	backend := &net.TCPAddr{IP: net.ParseIP("10.9.9.9"), Port: 8080}
+
+	conn := &fakeConn{}
+	if err := WriteProxyHeader(conn, client, backend, 1); err != nil {
+		t.Fatalf("WriteProxyHeader: %v", err)
+	}
+
+	r := bufio.NewReader(&conn.buf)
+	addr, ok, err := PeekProxyHeader(r)
+	if err != nil {
+		t.Fatalf("PeekProxyHeader: %v", err)
+	}
+	if !ok {
+		t.Fatal("PeekProxyHeader: ok = false, want true")
+	}
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		t.Fatalf("addr = %T, want *net.TCPAddr", addr)
+	}
+	if !tcpAddr.IP.Equal(client.IP) || tcpAddr.Port != client.Port {
+		t.Errorf("decoded addr = %s, want %s", tcpAddr, client)
+	}
+}
+
+func TestWriteProxyHeaderV2RoundTrip(t *testing.T) {
+	client := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 51234}
+	backend := &net.TCPAddr{IP: net.ParseIP("10.9.9.9"), Port: 8080}
+
+	conn := &fakeConn{}
+	if err := WriteProxyHeader(conn, client, backend, 2); err != nil {
+		t.Fatalf("WriteProxyHeader: %v", err)
+	}
+
+	r := bufio.NewReader(&conn.buf)
+	addr, ok, err := PeekProxyHeader(r)
+	if err != nil {
+		t.Fatalf("PeekProxyHeader: %v", err)
+	}
+	if !ok {
+		t.Fatal("PeekProxyHeader: ok = false, want true")
+	}
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		t.Fatalf("addr = %T, want *net.TCPAddr", addr)
+	}
+	if !tcpAddr.IP.Equal(client.IP) || tcpAddr.Port != client.Port {
+		t.Errorf("decoded addr = %s, want %s", tcpAddr, client)
+	}
+}
+
+func TestPeekProxyHeaderV2Local(t *testing.T) {
+	// a v2 LOCAL (health-check) frame: valid header, AF_UNSPEC family, no
+	// address block to decode.
+	var buf bytes.Buffer
+	buf.Write(proxyProtoV2Signature)
+	buf.WriteByte(0x20) // version 2, LOCAL command
+	buf.WriteByte(0x00) // AF_UNSPEC
+	buf.Write([]byte{0x00, 0x00})
+
+	r := bufio.NewReader(&buf)
+	addr, ok, err := PeekProxyHeader(r)
+	if err != nil {
+		t.Fatalf("PeekProxyHeader: %v", err)
+	}
+	if !ok {
+		t.Fatal("PeekProxyHeader: ok = false, want true for a valid LOCAL frame")
+	}
+	if addr != nil {
+		t.Errorf("addr = %v, want nil for a LOCAL frame", addr)
+	}
+}
+
+func TestPeekProxyHeaderNoHeaderLeavesStreamIntact(t *testing.T) {
+	body := "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	r := bufio.NewReader(strings.NewReader(body))
+
+	addr, ok, err := PeekProxyHeader(r)
+	if err != nil {
+		t.Fatalf("PeekProxyHeader: %v", err)
+	}
+	if ok {
+		t.Fatal("PeekProxyHeader: ok = true, want false for an ordinary request")
+	}
+	if addr != nil {
+		t.Errorf("addr = %v, want nil", addr)
+	}
+
+	rest, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("ReadString: %v", err)
+	}
+	if rest != "GET / HTTP/1.1\r\n" {
+		t.Errorf("stream was disturbed: first line read back as %q", rest)
+	}
+}